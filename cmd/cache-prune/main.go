@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/name"
+
+	"github.com/GoogleContainerTools/kaniko/pkg/cache/prune"
+)
+
+func main() {
+	var (
+		until    time.Duration
+		maxSize  int64
+		keepLast int
+		label    string
+	)
+	flag.DurationVar(&until, "until", 0, "Delete cache entries last pushed more than this long ago.")
+	flag.Int64Var(&maxSize, "max-size", 0, "Evict the oldest cache entries until the remaining entries total at most this many bytes.")
+	flag.IntVar(&keepLast, "keep-last", 0, "Always keep the N most recently pushed cache entries.")
+	flag.StringVar(&label, "label", "", "Only prune entries whose cache annotations match key=value.")
+	flag.Parse()
+
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: kaniko-cache-prune [flags] <cache-repo>")
+		os.Exit(1)
+	}
+
+	repo, err := name.NewRepository(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid cache repo %q: %s\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+
+	opts := prune.Options{
+		MaxSize:  maxSize,
+		KeepLast: keepLast,
+		Label:    label,
+	}
+	// Only set Until if the flag was actually passed, so a bare
+	// `kaniko-cache-prune <repo>` refuses to run instead of silently
+	// treating the unset flag's zero value as "delete everything".
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "until" {
+			opts.Until = prune.Duration(until)
+		}
+	})
+
+	deleted, err := prune.Prune(repo, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "prune failed: %s\n", err)
+		os.Exit(1)
+	}
+
+	for _, tag := range deleted {
+		fmt.Println("deleted", tag)
+	}
+}
@@ -30,9 +30,13 @@ import (
 	"testing"
 	"time"
 
+	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/daemon"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
 
+	"github.com/GoogleContainerTools/kaniko/pkg/cache/prune"
 	"github.com/GoogleContainerTools/kaniko/pkg/timing"
 	"github.com/GoogleContainerTools/kaniko/pkg/util"
 	"github.com/GoogleContainerTools/kaniko/testutil"
@@ -42,9 +46,18 @@ var config *gcpConfig
 var imageBuilder *DockerFileBuilder
 
 const (
-	daemonPrefix       = "daemon://"
-	dockerfilesPath    = "dockerfiles"
-	emptyContainerDiff = `[
+	daemonPrefix    = "daemon://"
+	dockerfilesPath = "dockerfiles"
+	// schema1RegistryImage predates Docker Distribution's manifest schema2
+	// support (added in distribution 2.3.0); unlike a modern registry:2, it
+	// genuinely can't store a schema2 manifest, so it's suitable as a
+	// stand-in for the schema1-only mirrors (Quay, Artifactory) this test
+	// matrix cares about. startLocalRegistry verifies this at startup
+	// rather than trusting the tag alone.
+	schema1RegistryImage = "registry:2.2.1"
+	schema2RegistryImage = "registry:2"
+	cachePruneBinary     = "./out/kaniko-cache-prune"
+	emptyContainerDiff   = `[
      {
        "Image1": "%s",
        "Image2": "%s",
@@ -81,6 +94,57 @@ func getDockerMajorVersion() int {
 	return ver
 }
 
+// startLocalRegistry runs an ephemeral registry:2 container on a random host
+// port and returns its address in host:port form. It is used to give the
+// schema1/schema2 compatibility matrix a registry backend that isn't shared
+// with config.imageRepo.
+func startLocalRegistry(image string) (string, error) {
+	cmd := exec.Command("docker", "run", "-d", "-P", image)
+	out, err := RunCommandWithoutTest(cmd)
+	if err != nil {
+		return "", fmt.Errorf("starting registry container from %s: %s %s", image, err, string(out))
+	}
+	containerID := strings.TrimSpace(string(out))
+
+	portCmd := exec.Command("docker", "inspect", "-f",
+		"{{(index (index .NetworkSettings.Ports \"5000/tcp\") 0).HostPort}}", containerID)
+	portOut, err := RunCommandWithoutTest(portCmd)
+	if err != nil {
+		return "", fmt.Errorf("inspecting registry container %s: %s %s", containerID, err, string(portOut))
+	}
+	return "localhost:" + strings.TrimSpace(string(portOut)), nil
+}
+
+// verifySchema1OnlyRegistry pushes a throwaway schema2 image to addr and
+// fails loudly if the push succeeds. schema1RegistryImage is chosen to
+// predate schema2 support, but tags drift and get re-pulled from upstream,
+// so TestMain confirms the assumption holds before the schema1/schema2
+// matrix in TestRun relies on it.
+func verifySchema1OnlyRegistry(addr string) error {
+	ref, err := name.ParseReference(addr+"/kaniko-schema1-probe:latest", name.WeakValidation, name.Insecure)
+	if err != nil {
+		return fmt.Errorf("parsing probe reference for %s: %s", addr, err)
+	}
+	if err := remote.Write(ref, empty.Image, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err == nil {
+		return fmt.Errorf("registry %s accepted a schema2 manifest; it is not schema1-only and can't stand in for a legacy registry", addr)
+	}
+	return nil
+}
+
+func stopLocalRegistry(addr string) {
+	cmd := exec.Command("docker", "ps", "-q", "--filter", "publish="+strings.TrimPrefix(addr, "localhost:"))
+	out, err := RunCommandWithoutTest(cmd)
+	if err != nil {
+		fmt.Printf("Failed to find registry container for %s: %s\n", addr, err)
+		return
+	}
+	for _, containerID := range strings.Fields(string(out)) {
+		if _, err := RunCommandWithoutTest(exec.Command("docker", "rm", "-f", containerID)); err != nil {
+			fmt.Printf("Failed to remove registry container %s: %s\n", containerID, err)
+		}
+	}
+}
+
 func TestMain(m *testing.M) {
 	if !meetsRequirements() {
 		fmt.Println("Missing required tools")
@@ -88,6 +152,33 @@ func TestMain(m *testing.M) {
 	}
 	config = initGCPConfig()
 
+	if config.schema1RegistryAddr == "" {
+		addr, err := startLocalRegistry(schema1RegistryImage)
+		if err != nil {
+			fmt.Println("Failed to start schema1 registry:", err)
+			os.Exit(1)
+		}
+		config.schema1RegistryAddr = addr
+		RunOnInterrupt(func() { stopLocalRegistry(addr) })
+		defer stopLocalRegistry(addr)
+	}
+
+	if config.schema2RegistryAddr == "" {
+		addr, err := startLocalRegistry(schema2RegistryImage)
+		if err != nil {
+			fmt.Println("Failed to start schema2 registry:", err)
+			os.Exit(1)
+		}
+		config.schema2RegistryAddr = addr
+		RunOnInterrupt(func() { stopLocalRegistry(addr) })
+		defer stopLocalRegistry(addr)
+	}
+
+	if err := verifySchema1OnlyRegistry(config.schema1RegistryAddr); err != nil {
+		fmt.Println("schema1 registry failed verification:", err)
+		os.Exit(1)
+	}
+
 	if config.uploadToGCS {
 		contextFile, err := CreateIntegrationTarball()
 		if err != nil {
@@ -139,6 +230,10 @@ func TestMain(m *testing.M) {
 			name:    "Pushing hardlink base image",
 			command: []string{"docker", "push", config.hardlinkBaseImage},
 		},
+		{
+			name:    "Building kaniko-cache-prune binary",
+			command: []string{"go", "build", "-o", cachePruneBinary, "../cmd/cache-prune"},
+		},
 	}
 
 	for _, setupCmd := range setupCommands {
@@ -190,6 +285,38 @@ func TestRun(t *testing.T) {
 			expected := fmt.Sprintf(emptyContainerDiff, dockerImage, kanikoImage, dockerImage, kanikoImage)
 			checkContainerDiffOutput(t, diff, expected)
 
+			for _, registry := range []struct {
+				prefix            string
+				addr              string
+				wantSchemaVersion int64
+			}{
+				{"schema1_", config.schema1RegistryAddr, 1},
+				{"schema2_", config.schema2RegistryAddr, 2},
+			} {
+				registry := registry
+				t.Run(registry.prefix+dockerfile, func(t *testing.T) {
+					t.Parallel()
+					kanikoRegistryImage := pushDockerfileToRegistry(t, dockerfile, registry.addr)
+
+					gotSchemaVersion, err := getManifestSchemaVersion(kanikoRegistryImage)
+					if err != nil {
+						t.Fatalf("Couldn't read manifest for %s: %s", kanikoRegistryImage, err)
+					}
+					if gotSchemaVersion != registry.wantSchemaVersion {
+						t.Fatalf("manifest for %s has schemaVersion %d, want %d (kaniko's manifest writer regressed against this registry)",
+							kanikoRegistryImage, gotSchemaVersion, registry.wantSchemaVersion)
+					}
+
+					containerdiffCmd := exec.Command("container-diff", "diff", "--no-cache", "--insecure-registry",
+						daemonDockerImage, kanikoRegistryImage,
+						"-q", "--type=file", "--type=metadata", "--json")
+					diff := RunCommand(containerdiffCmd, t)
+					t.Logf("diff = %s", string(diff))
+
+					expected := fmt.Sprintf(emptyContainerDiff, dockerImage, kanikoRegistryImage, dockerImage, kanikoRegistryImage)
+					checkContainerDiffOutput(t, diff, expected)
+				})
+			}
 		})
 	}
 
@@ -305,6 +432,60 @@ func buildImage(t *testing.T, dockerfile string, imageBuilder *DockerFileBuilder
 	return
 }
 
+// pushDockerfileToRegistry builds dockerfile with kaniko and pushes it
+// directly to registryAddr (an ephemeral, --insecure local registry),
+// returning the resulting image reference. It's used by the
+// schema1/schema2 compatibility matrix in TestRun, which needs to target a
+// registry other than config.imageRepo. GetKanikoImage itself isn't
+// extended to take a registry argument here because it's defined outside
+// this file; instead this reuses its naming scheme and just swaps the
+// config.imageRepo prefix for registryAddr, so the schema1/schema2 matrix
+// stays in sync with however GetKanikoImage names images.
+func pushDockerfileToRegistry(t *testing.T, dockerfile, registryAddr string) string {
+	t.Helper()
+
+	kanikoImage := strings.Replace(GetKanikoImage(config.imageRepo, dockerfile), config.imageRepo, registryAddr+"/", 1)
+	dockerfilesDir, err := filepath.Abs(dockerfilesPath)
+	if err != nil {
+		t.Fatalf("Couldn't get absolute path of %s: %s", dockerfilesPath, err)
+	}
+	dockerRunFlags := []string{"run", "--net=host",
+		"-v", fmt.Sprintf("%s:/workspace", dockerfilesDir),
+	}
+	dockerRunFlags = addServiceAccountFlags(dockerRunFlags, config.serviceAccount)
+	dockerRunFlags = append(dockerRunFlags, ExecutorImage,
+		"-f", filepath.Join("/workspace", dockerfile),
+		"-d", kanikoImage,
+		"--insecure",
+		"-c", "dir:///workspace/")
+
+	cmd := exec.Command("docker", dockerRunFlags...)
+	RunCommand(cmd, t)
+	return kanikoImage
+}
+
+// getManifestSchemaVersion fetches image's manifest and returns its
+// top-level "schemaVersion" field (1 or 2), so callers can tell whether
+// kaniko's manifest writer actually produced the schema the target
+// registry was pinned to.
+func getManifestSchemaVersion(image string) (int64, error) {
+	ref, err := name.ParseReference(image, name.WeakValidation, name.Insecure)
+	if err != nil {
+		return 0, fmt.Errorf("parsing reference to image %s: %s", image, err)
+	}
+	desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return 0, fmt.Errorf("fetching manifest for %s: %s", image, err)
+	}
+	var m struct {
+		SchemaVersion int64 `json:"schemaVersion"`
+	}
+	if err := json.Unmarshal(desc.Manifest, &m); err != nil {
+		return 0, fmt.Errorf("parsing manifest for %s: %s", image, err)
+	}
+	return m.SchemaVersion, nil
+}
+
 // Build each image with kaniko twice, and then make sure they're exactly the same
 func TestCache(t *testing.T) {
 	populateVolumeCache()
@@ -344,6 +525,92 @@ func TestCache(t *testing.T) {
 	}
 }
 
+// TestCachePrune populates the registry-backed cache by running a cached
+// build twice, prunes it by invoking the kaniko-cache-prune binary with
+// --until=0s, and verifies the cache tags are gone and that a subsequent
+// build of the same Dockerfile re-populates the cache from scratch rather
+// than reusing the (now-deleted) layers.
+func TestCachePrune(t *testing.T) {
+	populateVolumeCache()
+
+	var dockerfile string
+	for f := range imageBuilder.TestCacheDockerfiles {
+		dockerfile = f
+		break
+	}
+	if dockerfile == "" {
+		t.Skip("no cached Dockerfiles configured")
+	}
+
+	cache := filepath.Join(config.imageRepo, "cache", fmt.Sprintf("%v", time.Now().UnixNano()))
+	if err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 0); err != nil {
+		t.Fatalf("error building cached image for the first time: %v", err)
+	}
+	if err := imageBuilder.buildCachedImages(config, cache, dockerfilesPath, 1); err != nil {
+		t.Fatalf("error building cached image for the second time: %v", err)
+	}
+
+	cacheRepo, err := name.NewRepository(strings.TrimSuffix(cache, "/"))
+	if err != nil {
+		t.Fatalf("Couldn't parse cache repo %s: %s", cache, err)
+	}
+
+	entriesBefore, err := prune.List(cacheRepo)
+	if err != nil {
+		t.Fatalf("Couldn't list cache entries in %s: %s", cache, err)
+	}
+	if len(entriesBefore) == 0 {
+		t.Fatalf("expected %s to have cache entries after two cached builds, found none", cache)
+	}
+	pruneStartedAt := time.Now()
+
+	pruneCmd := exec.Command(cachePruneBinary, "--until=0s", cache)
+	out := RunCommand(pruneCmd, t)
+	t.Logf("kaniko-cache-prune output: %s", string(out))
+
+	entriesAfter, err := prune.List(cacheRepo)
+	if err != nil {
+		t.Fatalf("Couldn't list cache entries in %s after prune: %s", cache, err)
+	}
+	if len(entriesAfter) != 0 {
+		t.Fatalf("expected %s to have no cache entries after prune, found %d", cache, len(entriesAfter))
+	}
+
+	// Rebuilding against the now-empty cache should be a cache miss: kaniko
+	// has nothing to pull, so it pushes a brand new cache entry rather than
+	// reusing one of the (now-deleted) layers from the first two builds.
+	kanikoImage := GetVersionedKanikoImage(config.imageRepo, dockerfile, 2)
+	dockerfilesDir, err := filepath.Abs(dockerfilesPath)
+	if err != nil {
+		t.Fatalf("Couldn't get absolute path of %s: %s", dockerfilesPath, err)
+	}
+	dockerRunFlags := []string{"run", "--net=host",
+		"-v", fmt.Sprintf("%s:/workspace", dockerfilesDir),
+	}
+	dockerRunFlags = addServiceAccountFlags(dockerRunFlags, config.serviceAccount)
+	dockerRunFlags = append(dockerRunFlags, ExecutorImage,
+		"-f", filepath.Join("/workspace", dockerfile),
+		"-d", kanikoImage,
+		"--cache=true",
+		"--cache-repo", cache,
+		"-c", "dir:///workspace/")
+	RunCommand(exec.Command("docker", dockerRunFlags...), t)
+
+	entriesRebuilt, err := prune.List(cacheRepo)
+	if err != nil {
+		t.Fatalf("Couldn't list cache entries in %s after rebuild: %s", cache, err)
+	}
+	if len(entriesRebuilt) == 0 {
+		t.Fatalf("expected rebuild after prune to push fresh cache entries to %s, found none", cache)
+	}
+	for _, e := range entriesRebuilt {
+		if e.Pushed.Before(pruneStartedAt) {
+			t.Errorf("cache entry %s was pushed at %s, before prune ran at %s: rebuild reused a stale layer instead of missing the cache",
+				e.Tag, e.Pushed, pruneStartedAt)
+		}
+	}
+}
+
 func TestRelativePaths(t *testing.T) {
 
 	dockerfile := "Dockerfile_test_copy"
@@ -536,13 +803,15 @@ func logBenchmarks(benchmark string) error {
 }
 
 type gcpConfig struct {
-	gcsBucket          string
-	imageRepo          string
-	onbuildBaseImage   string
-	hardlinkBaseImage  string
-	serviceAccount     string
-	dockerMajorVersion int
-	uploadToGCS        bool
+	gcsBucket           string
+	imageRepo           string
+	onbuildBaseImage    string
+	hardlinkBaseImage   string
+	serviceAccount      string
+	dockerMajorVersion  int
+	uploadToGCS         bool
+	schema1RegistryAddr string
+	schema2RegistryAddr string
 }
 
 type imageDetails struct {
@@ -561,6 +830,8 @@ func initGCPConfig() *gcpConfig {
 	flag.StringVar(&c.imageRepo, "repo", "gcr.io/kaniko-test", "The (docker) image repo to build and push images to during the test. `gcloud` must be authenticated with this repo or serviceAccount must be set.")
 	flag.StringVar(&c.serviceAccount, "serviceAccount", "", "The path to the service account push images to GCR and upload/download files to GCS.")
 	flag.BoolVar(&c.uploadToGCS, "uploadToGCS", true, "Upload the tar-ed contents of `integration` dir to GCS bucket. Default is true. Set this to false to prevent uploading.")
+	flag.StringVar(&c.schema1RegistryAddr, "schema1Registry", "", "The address of a registry that only serves manifest schema1. If unset, an ephemeral registry:2.2.1 container is started for the duration of the test run.")
+	flag.StringVar(&c.schema2RegistryAddr, "schema2Registry", "", "The address of a registry that serves manifest schema2. If unset, an ephemeral registry:2 container is started for the duration of the test run.")
 	flag.Parse()
 
 	if len(c.serviceAccount) > 0 {
@@ -0,0 +1,230 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package prune implements garbage collection for the registry-backed
+// layer cache kaniko writes with --cache-repo. Caches in shared CI
+// clusters grow without bound unless something periodically deletes old
+// entries, so this package scans a cache repo and deletes entries that
+// match a combination of filters, modeled on the filter-driven prune used
+// elsewhere in the container tooling ecosystem.
+package prune
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+)
+
+// Options selects which cache entries to delete. The zero value is
+// refused by Prune: at least one of Until, MaxSize or KeepLast must be
+// set, so a caller that forgets to set any filter can't accidentally wipe
+// an entire cache.
+type Options struct {
+	// Until deletes entries last pushed more than Until ago. Until is a
+	// pointer so an explicit "0s" (delete everything) can be told apart
+	// from "not set" (don't filter by age at all). Use Duration(d) to
+	// build one.
+	Until *time.Duration
+	// MaxSize, if > 0, evicts the oldest entries (by push time) until the
+	// remaining entries' total compressed size is at or under MaxSize.
+	MaxSize int64
+	// KeepLast, if > 0, always retains the KeepLast most recently pushed
+	// entries, exempting them from both the Until and MaxSize filters.
+	KeepLast int
+	// Label, if set as "key=value", only considers entries whose cache
+	// annotations contain a matching key/value pair.
+	Label string
+}
+
+// Duration returns a *time.Duration for use as Options.Until.
+func Duration(d time.Duration) *time.Duration { return &d }
+
+// Entry describes one cache tag in a repository.
+type Entry struct {
+	Tag    name.Tag
+	Digest string
+	Size   int64
+	Pushed time.Time
+	Labels map[string]string
+}
+
+// List returns every cache entry in repo, newest first.
+func List(repo name.Repository) ([]Entry, error) {
+	tags, err := remote.List(repo, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+	if err != nil {
+		return nil, fmt.Errorf("listing tags in %s: %s", repo, err)
+	}
+
+	entries := make([]Entry, 0, len(tags))
+	for _, tag := range tags {
+		ref := repo.Tag(tag)
+		desc, err := remote.Get(ref, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return nil, fmt.Errorf("reading manifest for %s: %s", ref, err)
+		}
+		img, err := desc.Image()
+		if err != nil {
+			return nil, fmt.Errorf("reading image for %s: %s", ref, err)
+		}
+		cfg, err := img.ConfigFile()
+		if err != nil {
+			return nil, fmt.Errorf("reading config for %s: %s", ref, err)
+		}
+		layers, err := img.Layers()
+		if err != nil {
+			return nil, fmt.Errorf("reading layers for %s: %s", ref, err)
+		}
+		manifest, err := img.Manifest()
+		if err != nil {
+			return nil, fmt.Errorf("parsing manifest for %s: %s", ref, err)
+		}
+		annotations := make(map[string]string)
+		for k, v := range manifest.Annotations {
+			annotations[k] = v
+		}
+		for _, l := range manifest.Layers {
+			for k, v := range l.Annotations {
+				annotations[k] = v
+			}
+		}
+		var size int64
+		for _, layer := range layers {
+			layerSize, err := layer.Size()
+			if err != nil {
+				return nil, fmt.Errorf("reading layer size for %s: %s", ref, err)
+			}
+			size += layerSize
+		}
+		entries = append(entries, Entry{
+			Tag:    ref,
+			Digest: desc.Digest.String(),
+			Size:   size,
+			Pushed: cfg.Created.Time,
+			Labels: annotations,
+		})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Pushed.After(entries[j].Pushed) })
+	return entries, nil
+}
+
+// Prune deletes the entries in repo matched by opts and returns the tags
+// it deleted. It refuses a zero-value Options, since that would otherwise
+// match (and delete) every entry in repo.
+func Prune(repo name.Repository, opts Options) ([]string, error) {
+	if opts.Until == nil && opts.MaxSize <= 0 && opts.KeepLast <= 0 {
+		return nil, fmt.Errorf("prune: at least one of Until, MaxSize, or KeepLast must be set")
+	}
+
+	entries, err := List(repo)
+	if err != nil {
+		return nil, err
+	}
+
+	labelKey, labelVal, err := parseLabel(opts.Label)
+	if err != nil {
+		return nil, err
+	}
+
+	var cutoff time.Time
+	if opts.Until != nil {
+		cutoff = time.Now().Add(-*opts.Until)
+	}
+
+	var toDelete []Entry
+	for i, e := range entries {
+		if opts.KeepLast > 0 && i < opts.KeepLast {
+			continue
+		}
+		if labelKey != "" && e.Labels[labelKey] != labelVal {
+			continue
+		}
+		if opts.Until != nil && !e.Pushed.Before(cutoff) {
+			continue
+		}
+		toDelete = append(toDelete, e)
+	}
+
+	if opts.MaxSize > 0 {
+		toDelete = append(toDelete, evictForSize(entries, toDelete, opts.KeepLast, opts.MaxSize, labelKey, labelVal)...)
+	}
+
+	deleted := make([]string, 0, len(toDelete))
+	for _, e := range toDelete {
+		if err := remote.Delete(e.Tag, remote.WithAuthFromKeychain(authn.DefaultKeychain)); err != nil {
+			return deleted, fmt.Errorf("deleting %s: %s", e.Tag, err)
+		}
+		deleted = append(deleted, e.Tag.TagStr())
+	}
+
+	return deleted, nil
+}
+
+// evictForSize walks entries oldest-first, skipping anything already
+// marked for deletion, the keepLast most recent entries (entries[:keepLast],
+// since entries is sorted newest-first), and (if labelKey is set) entries
+// whose labels don't match labelKey/labelVal, and returns additional
+// entries to delete (an LRU eviction) until the remaining total size is at
+// or under maxSize. Only entries matching the label filter count toward
+// total or get evicted, mirroring the Until-based pass in Prune.
+func evictForSize(entries, alreadyDeleting []Entry, keepLast int, maxSize int64, labelKey, labelVal string) []Entry {
+	deleting := make(map[name.Tag]bool, len(alreadyDeleting))
+	for _, e := range alreadyDeleting {
+		deleting[e.Tag] = true
+	}
+	protected := make(map[name.Tag]bool, keepLast)
+	for i := 0; i < keepLast && i < len(entries); i++ {
+		protected[entries[i].Tag] = true
+	}
+	matches := func(e Entry) bool {
+		return labelKey == "" || e.Labels[labelKey] == labelVal
+	}
+
+	var total int64
+	for _, e := range entries {
+		if !deleting[e.Tag] && matches(e) {
+			total += e.Size
+		}
+	}
+
+	var evicted []Entry
+	for i := len(entries) - 1; i >= 0 && total > maxSize; i-- {
+		e := entries[i]
+		if deleting[e.Tag] || protected[e.Tag] || !matches(e) {
+			continue
+		}
+		evicted = append(evicted, e)
+		deleting[e.Tag] = true
+		total -= e.Size
+	}
+	return evicted
+}
+
+func parseLabel(label string) (key, value string, err error) {
+	if label == "" {
+		return "", "", nil
+	}
+	for i := 0; i < len(label); i++ {
+		if label[i] == '=' {
+			return label[:i], label[i+1:], nil
+		}
+	}
+	return "", "", fmt.Errorf("invalid --label %q: expected key=value", label)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Google LLC
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package prune
+
+import (
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func mustTag(t *testing.T, tag string) name.Tag {
+	t.Helper()
+	ref, err := name.NewTag(tag)
+	if err != nil {
+		t.Fatalf("parsing tag %q: %s", tag, err)
+	}
+	return ref
+}
+
+// TestEvictForSizeRespectsLabel exercises the bug fixed alongside
+// switching Entry.Size to a summed-layer size: evictForSize must ignore
+// entries that don't match an explicit --label filter, the same way the
+// Until-based pass in Prune does, rather than treating every entry in
+// repo as eviction-eligible.
+func TestEvictForSizeRespectsLabel(t *testing.T) {
+	entries := []Entry{
+		{Tag: mustTag(t, "r/cache:a"), Size: 100, Labels: map[string]string{"branch": "main"}},
+		{Tag: mustTag(t, "r/cache:b"), Size: 100, Labels: map[string]string{"branch": "main"}},
+		{Tag: mustTag(t, "r/cache:c"), Size: 100, Labels: map[string]string{"branch": "feature"}},
+	}
+
+	evicted := evictForSize(entries, nil, 0, 0, "branch", "main")
+
+	if len(evicted) != 2 {
+		t.Fatalf("expected evictForSize to only evict the 2 entries matching branch=main, evicted %d: %v", len(evicted), evicted)
+	}
+	for _, e := range evicted {
+		if e.Labels["branch"] != "main" {
+			t.Errorf("evictForSize evicted %s, whose branch label is %q, not the requested \"main\"", e.Tag, e.Labels["branch"])
+		}
+	}
+}
+
+// TestEvictForSizeKeepsUnmatchedEntriesOutOfTotal makes sure entries that
+// don't match the label filter aren't counted against maxSize either: a
+// cache holding nothing but non-matching entries should never be evicted
+// from just because their combined size exceeds maxSize.
+func TestEvictForSizeKeepsUnmatchedEntriesOutOfTotal(t *testing.T) {
+	entries := []Entry{
+		{Tag: mustTag(t, "r/cache:a"), Size: 1000, Labels: map[string]string{"branch": "feature"}},
+	}
+
+	evicted := evictForSize(entries, nil, 0, 10, "branch", "main")
+
+	if len(evicted) != 0 {
+		t.Fatalf("expected no evictions when no entry matches the label filter, evicted %v", evicted)
+	}
+}
+
+// TestEvictForSizeKeepsLast ensures the keepLast most recent entries are
+// exempt from size-based eviction even once they're the only ones left.
+func TestEvictForSizeKeepsLast(t *testing.T) {
+	entries := []Entry{
+		{Tag: mustTag(t, "r/cache:newest"), Size: 100},
+		{Tag: mustTag(t, "r/cache:oldest"), Size: 100},
+	}
+
+	evicted := evictForSize(entries, nil, 1, 0, "", "")
+
+	if len(evicted) != 1 || evicted[0].Tag.TagStr() != "oldest" {
+		t.Fatalf("expected only the non-kept oldest entry to be evicted, got %v", evicted)
+	}
+}